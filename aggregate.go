@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/malice-plugins/pkgs/utils"
+	"github.com/pkg/errors"
+)
+
+// ScanReport is a vendor-neutral scan result schema that aggregator
+// frontends (Harbor, Vuls, etc) can consume regardless of which
+// malice-plugins scanner produced it.
+type ScanReport struct {
+	Scanner       string    `json:"scanner"`
+	EngineVersion string    `json:"engine_version"`
+	DatabaseDate  string    `json:"database_date"`
+	Infected      bool      `json:"infected"`
+	ThreatName    string    `json:"threat_name,omitempty"`
+	Severity      string    `json:"severity"`
+	SHA256        string    `json:"sha256"`
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+	Duration      string    `json:"duration"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// toScanReport normalizes a McAfee result into the vendor-neutral ScanReport schema.
+func toScanReport(mcafee McAfee, sha256 string, started, finished time.Time) ScanReport {
+	severity := "none"
+	if mcafee.Results.Infected {
+		severity = "malicious"
+	}
+
+	return ScanReport{
+		Scanner:       name,
+		EngineVersion: mcafee.Results.Engine,
+		DatabaseDate:  mcafee.Results.Database,
+		Infected:      mcafee.Results.Infected,
+		ThreatName:    mcafee.Results.Result,
+		Severity:      severity,
+		SHA256:        sha256,
+		StartedAt:     started,
+		FinishedAt:    finished,
+		Duration:      finished.Sub(started).String(),
+	}
+}
+
+// AggregateReport is the combined result of fanning a file out to every
+// sibling scanner endpoint plus this plugin's own local scan.
+type AggregateReport struct {
+	SHA256   string                 `json:"sha256"`
+	Verdict  string                 `json:"verdict"`
+	Scanners map[string]*ScanReport `json:"scanners"`
+	Errors   map[string]string      `json:"errors,omitempty"`
+}
+
+// combineVerdict reduces a set of ScanReports into a single any-infected verdict.
+// Scanners that errored out are not counted either way.
+func combineVerdict(reports map[string]*ScanReport) string {
+	infected := 0
+	for _, r := range reports {
+		if r != nil && r.Infected {
+			infected++
+		}
+	}
+	if infected > 0 {
+		return "infected"
+	}
+	if len(reports) == 0 {
+		return "unknown"
+	}
+	return "clean"
+}
+
+// scanSibling uploads filePath to a malice-plugins style `/scan` endpoint and
+// decodes the response into a ScanReport keyed by scanner name.
+func scanSibling(endpoint, filePath string) (*ScanReport, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open file for aggregate scan")
+	}
+	defer file.Close()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("malware", filePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create multipart form")
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return nil, errors.Wrap(err, "failed to copy file into multipart form")
+	}
+	if err := writer.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to close multipart writer")
+	}
+
+	req, err := http.NewRequest("POST", endpoint, &body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build sibling scan request")
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	started := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to reach sibling scanner %s", endpoint)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read sibling scanner response")
+	}
+
+	report := &ScanReport{
+		Scanner:    endpoint,
+		StartedAt:  started,
+		FinishedAt: time.Now(),
+	}
+	if resp.StatusCode != http.StatusOK {
+		return report, errors.Errorf("sibling scanner %s returned status %d: %s", endpoint, resp.StatusCode, string(data))
+	}
+
+	var generic map[string]ResultsData
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return report, errors.Wrapf(err, "failed to decode sibling scanner %s response", endpoint)
+	}
+	for scanner, results := range generic {
+		severity := "none"
+		if results.Infected {
+			severity = "malicious"
+		}
+		report.Scanner = scanner
+		report.EngineVersion = results.Engine
+		report.DatabaseDate = results.Database
+		report.Infected = results.Infected
+		report.ThreatName = results.Result
+		report.Severity = severity
+		break
+	}
+	report.Duration = report.FinishedAt.Sub(report.StartedAt).String()
+
+	return report, nil
+}
+
+// aggregateScan runs the local McAfee scan plus every sibling endpoint
+// concurrently and merges the results into a single AggregateReport.
+func aggregateScan(filePath string, timeout int, endpoints []string) AggregateReport {
+	sha256 := utils.GetSHA256(filePath)
+
+	report := AggregateReport{
+		SHA256:   sha256,
+		Scanners: make(map[string]*ScanReport),
+		Errors:   make(map[string]string),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		started := time.Now()
+		mcafee, err := AvScan(filePath, timeout)
+		finished := time.Now()
+		if err == nil {
+			recordScanMetrics(mcafee, finished.Sub(started))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"plugin":   name,
+				"category": category,
+			}).Error(err)
+			report.Errors[name] = err.Error()
+			return
+		}
+		sr := toScanReport(mcafee, sha256, started, finished)
+		report.Scanners[name] = &sr
+	}()
+
+	for _, endpoint := range endpoints {
+		endpoint := strings.TrimSpace(endpoint)
+		if endpoint == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(endpoint string) {
+			defer wg.Done()
+			sr, err := scanSibling(endpoint, filePath)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"plugin":   name,
+					"category": category,
+					"endpoint": endpoint,
+				}).Error(err)
+				report.Errors[endpoint] = err.Error()
+				return
+			}
+			if sr != nil {
+				report.Scanners[sr.Scanner] = sr
+			}
+		}(endpoint)
+	}
+
+	wg.Wait()
+
+	if len(report.Errors) == 0 {
+		report.Errors = nil
+	}
+	report.Verdict = combineVerdict(report.Scanners)
+
+	return report
+}
+
+func webAggregateScan(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	reqLog := log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"remote":   r.RemoteAddr,
+	})
+
+	r.ParseMultipartForm(32 << 20)
+	file, header, err := r.FormFile("malware")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "please supply a valid file to scan"))
+		return
+	}
+	defer file.Close()
+
+	reqLog = reqLog.WithField("filename", header.Filename)
+	reqLog.WithField("size", header.Size).Debug("received upload")
+
+	tmpfile, err := ioutil.TempFile("/malware", "aggregate_")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to create temp file"))
+		return
+	}
+	defer os.Remove(tmpfile.Name())
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to read uploaded file"))
+		return
+	}
+	if _, err := tmpfile.Write(data); err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to write temp file"))
+		return
+	}
+	if err := tmpfile.Close(); err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to close temp file"))
+		return
+	}
+
+	endpoints := strings.Split(os.Getenv("MALICE_AGGREGATE_ENDPOINTS"), ",")
+	report := aggregateScan(tmpfile.Name(), 60, endpoints)
+
+	reqLog.WithFields(log.Fields{
+		"sha256":   report.SHA256,
+		"duration": time.Since(started),
+		"verdict":  report.Verdict,
+	}).Info("completed aggregate scan")
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		reqLog.Error(errors.Wrap(err, "failed to encode aggregate response"))
+	}
+}
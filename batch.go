@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/malice-plugins/pkgs/utils"
+	"github.com/pkg/errors"
+)
+
+// BatchResult is the aggregate verdict for a directory/archive scan target,
+// combining a per-entry breakdown with a top-level infected summary.
+type BatchResult struct {
+	Path          string       `json:"path"`
+	Infected      bool         `json:"infected"`
+	InfectedCount int          `json:"infected_count"`
+	Files         []FileResult `json:"files"`
+}
+
+// batchScanPath runs `scan -abfu` against path (a file, directory, or
+// archive) and returns a verdict per file McAfee reports on.
+func batchScanPath(targetPath string, timeout int) (BatchResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	output, err := utils.RunCommand(ctx, "scan", "-abfu", targetPath)
+	if err != nil {
+		return BatchResult{}, errors.Wrapf(err, "failed to scan %s", targetPath)
+	}
+
+	files, err := ParseMcAfeeOutputMulti(output)
+	if err != nil {
+		return BatchResult{}, errors.Wrapf(err, "failed to parse scan output for %s", targetPath)
+	}
+
+	result := BatchResult{Path: targetPath, Files: files}
+	for _, file := range files {
+		if file.Infected {
+			result.Infected = true
+			result.InfectedCount++
+		}
+	}
+
+	return result, nil
+}
+
+// webBatchScan accepts multiple files in one multipart request and streams
+// back an NDJSON document per file as each completes, so bulk callers don't
+// have to issue one HTTP request per sample.
+func webBatchScan(w http.ResponseWriter, r *http.Request) {
+	reqLog := log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"remote":   r.RemoteAddr,
+	})
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "failed to parse multipart form"))
+		return
+	}
+
+	headers := r.MultipartForm.File["malware"]
+	if len(headers) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("please supply one or more files to scan"))
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+
+	for _, header := range headers {
+		started := time.Now()
+
+		result, err := scanBatchEntry(header)
+		duration := time.Since(started)
+		if err != nil {
+			reqLog.WithFields(log.Fields{
+				"filename": header.Filename,
+				"duration": duration,
+			}).Error("batch scan failed: ", err)
+			encoder.Encode(errorResponse{Error: err.Error()})
+			if flusher != nil {
+				flusher.Flush()
+			}
+			continue
+		}
+		recordScanOutcomeMetrics(result.Infected, duration)
+
+		reqLog.WithFields(log.Fields{
+			"filename": header.Filename,
+			"duration": duration,
+			"infected": result.Infected,
+		}).Info("completed batch entry")
+
+		encoder.Encode(result)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// scanBatchEntry persists one uploaded multipart file to a temp file and
+// scans it, returning a BatchResult keyed by the original filename.
+func scanBatchEntry(header *multipart.FileHeader) (BatchResult, error) {
+	file, err := header.Open()
+	if err != nil {
+		return BatchResult{}, errors.Wrapf(err, "failed to open uploaded file %s", header.Filename)
+	}
+	defer file.Close()
+
+	tmpfile, err := ioutil.TempFile("/malware", "batch_")
+	if err != nil {
+		return BatchResult{}, errors.Wrap(err, "failed to create temp file")
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	if _, err := io.Copy(tmpfile, file); err != nil {
+		return BatchResult{}, errors.Wrapf(err, "failed to write temp file for %s", header.Filename)
+	}
+	if err := tmpfile.Close(); err != nil {
+		return BatchResult{}, errors.Wrap(err, "failed to close temp file")
+	}
+
+	result, err := batchScanPath(tmpfile.Name(), 60)
+	if err != nil {
+		return BatchResult{}, err
+	}
+	result.Path = header.Filename
+
+	return result, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/malice-plugins/pkgs/utils"
+	"github.com/pkg/errors"
+
+	"github.com/malice-plugins/mcafee/history"
+)
+
+// ScanDiff is the structured delta between the current scan and the last
+// persisted scan for the same file hash.
+type ScanDiff struct {
+	SHA256            string   `json:"sha256"`
+	NewDetections     []string `json:"new_detections,omitempty"`
+	ClearedDetections []string `json:"cleared_detections,omitempty"`
+	PreviousEngine    string   `json:"previous_engine,omitempty"`
+	CurrentEngine     string   `json:"current_engine,omitempty"`
+	EngineChanged     bool     `json:"engine_changed"`
+	PreviousDatabase  string   `json:"previous_database,omitempty"`
+	CurrentDatabase   string   `json:"current_database,omitempty"`
+	SignatureAged     bool     `json:"signature_aged"`
+	HasPrevious       bool     `json:"has_previous"`
+}
+
+// diffScan scans path, diffs it against the last persisted result for the
+// same sha256 (if any) in store, and persists the new result for next time.
+func diffScan(store *history.Store, filePath string, timeout int) (ScanDiff, McAfee, error) {
+	mcafee, err := AvScan(filePath, timeout)
+	if err != nil {
+		return ScanDiff{}, McAfee{}, errors.Wrap(err, "failed to scan file")
+	}
+
+	sha256 := utils.GetSHA256(filePath)
+
+	diff := ScanDiff{
+		SHA256:          sha256,
+		CurrentEngine:   mcafee.Results.Engine,
+		CurrentDatabase: mcafee.Results.Database,
+	}
+
+	var previous pluginResults
+	ok, err := history.LoadPrevious(store.Dir, sha256, &previous)
+	if err != nil {
+		return diff, mcafee, errors.Wrap(err, "failed to load previous scan result")
+	}
+
+	if ok {
+		diff.HasPrevious = true
+		diff.PreviousEngine = previous.Data.Engine
+		diff.PreviousDatabase = previous.Data.Database
+		diff.EngineChanged = previous.Data.Engine != mcafee.Results.Engine
+		diff.SignatureAged = previous.Data.Database != mcafee.Results.Database
+
+		switch {
+		case !previous.Data.Infected && mcafee.Results.Infected:
+			diff.NewDetections = []string{mcafee.Results.Result}
+		case previous.Data.Infected && !mcafee.Results.Infected:
+			diff.ClearedDetections = []string{previous.Data.Result}
+		case previous.Data.Infected && mcafee.Results.Infected && previous.Data.Result != mcafee.Results.Result:
+			diff.ClearedDetections = []string{previous.Data.Result}
+			diff.NewDetections = []string{mcafee.Results.Result}
+		}
+	}
+
+	if err := store.Save(sha256, pluginResults{ID: sha256, Data: mcafee.Results}); err != nil {
+		return diff, mcafee, errors.Wrap(err, "failed to persist scan result to history")
+	}
+
+	return diff, mcafee, nil
+}
+
+func webDiffScan(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	reqLog := log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"remote":   r.RemoteAddr,
+	})
+
+	r.ParseMultipartForm(32 << 20)
+	file, header, err := r.FormFile("malware")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "please supply a valid file to scan"))
+		return
+	}
+	defer file.Close()
+
+	reqLog = reqLog.WithField("filename", header.Filename)
+	reqLog.WithField("size", header.Size).Debug("received upload")
+
+	tmpfile, err := ioutil.TempFile("/malware", "diff_")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to create temp file"))
+		return
+	}
+	defer os.Remove(tmpfile.Name())
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to read uploaded file"))
+		return
+	}
+	if _, err := tmpfile.Write(data); err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to write temp file"))
+		return
+	}
+	if err := tmpfile.Close(); err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to close temp file"))
+		return
+	}
+
+	sha256 := utils.GetSHA256(tmpfile.Name())
+	reqLog = reqLog.WithField("sha256", sha256)
+
+	diff, mcafee, err := diffScan(history.NewStore(os.Getenv("MALICE_HISTORY_DIR")), tmpfile.Name(), 60)
+	duration := time.Since(started)
+	if err != nil {
+		reqLog.WithField("duration", duration).Error("diff scan failed: ", err)
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to diff scan against history"))
+		return
+	}
+	recordScanMetrics(mcafee, duration)
+
+	reqLog.WithFields(log.Fields{
+		"duration": duration,
+		"verdict":  mcafee.Results.Infected,
+	}).Info("completed diff scan")
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(diff); err != nil {
+		reqLog.Error(errors.Wrap(err, "failed to encode diff response"))
+	}
+}
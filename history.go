@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/malice-plugins/mcafee/history"
+)
+
+// sha256Pattern matches a well-formed sha256 hex digest, so a {sha256} path
+// param can't be used to escape the history store (e.g. "..") and read
+// arbitrary directories on disk.
+var sha256Pattern = regexp.MustCompile(`^[a-fA-F0-9]{64}$`)
+
+// historyDir returns the configured history directory, falling back to
+// history.DefaultDir the same way the CLI --diff flow and webDiffScan do.
+func historyDir() string {
+	if dir := os.Getenv("MALICE_HISTORY_DIR"); dir != "" {
+		return dir
+	}
+	return history.DefaultDir
+}
+
+// webListScanHistory lists the sha256 hashes that have at least one
+// persisted scan result, so callers know what they can walk with
+// webScanHistory.
+func webListScanHistory(w http.ResponseWriter, r *http.Request) {
+	reqLog := log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"remote":   r.RemoteAddr,
+	})
+
+	dirs, err := history.ListValidJSONDirs(historyDir())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to list scan history"))
+		return
+	}
+
+	reqLog.WithField("count", len(dirs)).Debug("listed scan history")
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(dirs); err != nil {
+		reqLog.Error(errors.Wrap(err, "failed to encode scan history list response"))
+	}
+}
+
+// webScanHistory returns every persisted scan result for a given sha256,
+// oldest first, so a caller can walk how a file's verdict has changed
+// across signature updates instead of only seeing the most recent scan.
+func webScanHistory(w http.ResponseWriter, r *http.Request) {
+	sha256 := mux.Vars(r)["sha256"]
+	reqLog := log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"remote":   r.RemoteAddr,
+		"sha256":   sha256,
+	})
+
+	if !sha256Pattern.MatchString(sha256) {
+		writeError(w, http.StatusBadRequest, errors.Errorf("%q is not a valid sha256 hash", sha256))
+		return
+	}
+
+	var results []pluginResults
+	if err := history.LoadScanResults(historyDir(), sha256, &results); err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrapf(err, "failed to load scan history for %s", sha256))
+		return
+	}
+	if len(results) == 0 {
+		writeError(w, http.StatusNotFound, errors.Errorf("no scan history found for %s", sha256))
+		return
+	}
+
+	reqLog.WithField("count", len(results)).Debug("loaded scan history")
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		reqLog.Error(errors.Wrap(err, "failed to encode scan history response"))
+	}
+}
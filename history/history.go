@@ -0,0 +1,163 @@
+// Package history stores and retrieves past scan results so a plugin can
+// diff a new scan against what was last seen for the same file hash.
+package history
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultDir is where scan history is persisted when no override is given.
+const DefaultDir = "/malice/history"
+
+// Store persists and loads per-file scan history as JSON on disk, laid out
+// as <dir>/<sha256>/<unix-timestamp>.json so history can be walked in order.
+type Store struct {
+	Dir string
+}
+
+// NewStore creates a Store rooted at dir. An empty dir defaults to DefaultDir.
+func NewStore(dir string) *Store {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Store{Dir: dir}
+}
+
+// Save writes result as the latest scan history entry for sha256.
+func (s *Store) Save(sha256 string, result interface{}) error {
+	dir := filepath.Join(s.Dir, sha256)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create history dir for %s", sha256)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal scan result for history")
+	}
+
+	file := filepath.Join(dir, strconv.FormatInt(time.Now().Unix(), 10)+".json")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write history file %s", file)
+	}
+
+	return nil
+}
+
+// ListValidJSONDirs returns the sha256 subdirectories under dir that contain
+// at least one persisted scan result.
+func ListValidJSONDirs(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read history dir %s", dir)
+	}
+
+	var dirs []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		files, err := scanFiles(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 0 {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+
+	return dirs, nil
+}
+
+// LoadScanResults loads every persisted scan for sha256, oldest first, into
+// out (a pointer to a slice of the caller's result type).
+func LoadScanResults(dir, sha256 string, out interface{}) error {
+	files, err := scanFiles(filepath.Join(dir, sha256))
+	if err != nil {
+		return err
+	}
+
+	raw := make([]json.RawMessage, 0, len(files))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read history file %s", file)
+		}
+		raw = append(raw, data)
+	}
+
+	wrapped, err := json.Marshal(raw)
+	if err != nil {
+		return errors.Wrap(err, "failed to re-marshal history entries")
+	}
+
+	return json.Unmarshal(wrapped, out)
+}
+
+// LoadPrevious loads the most recently persisted scan for sha256, if any.
+// It returns ok=false when no history exists yet for that hash.
+func LoadPrevious(dir, sha256 string, out interface{}) (ok bool, err error) {
+	files, err := scanFiles(filepath.Join(dir, sha256))
+	if err != nil {
+		return false, err
+	}
+	if len(files) == 0 {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(files[len(files)-1])
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read history file %s", files[len(files)-1])
+	}
+
+	if err := json.Unmarshal(data, out); err != nil {
+		return false, errors.Wrap(err, "failed to unmarshal previous scan result")
+	}
+
+	return true, nil
+}
+
+// scanFiles returns the <timestamp>.json files in dir sorted oldest to newest.
+func scanFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read history dir %s", dir)
+	}
+
+	var timestamps []int64
+	byTimestamp := make(map[int64]string)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		ts, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		timestamps = append(timestamps, ts)
+		byTimestamp[ts] = filepath.Join(dir, entry.Name())
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	files := make([]string, 0, len(timestamps))
+	for _, ts := range timestamps {
+		files = append(files, byTimestamp[ts])
+	}
+
+	return files, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	scansTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "malice",
+		Subsystem: name,
+		Name:      "scans_total",
+		Help:      "Total number of scans performed by the mcafee plugin.",
+	})
+
+	infectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "malice",
+		Subsystem: name,
+		Name:      "infected_total",
+		Help:      "Total number of scans that detected an infection.",
+	})
+
+	scanDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "malice",
+		Subsystem: name,
+		Name:      "scan_duration_seconds",
+		Help:      "Time taken to complete a scan, in seconds.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	updatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "malice",
+		Subsystem: name,
+		Name:      "updates_total",
+		Help:      "Total number of signature database update attempts, by result.",
+	}, []string{"result"})
+
+	licenseDaysRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "malice",
+		Subsystem: name,
+		Name:      "license_days_remaining",
+		Help:      "Days remaining until the mcafee license expires (negative if already expired).",
+	})
+
+	signatureDatabaseAgeDays = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "malice",
+		Subsystem: name,
+		Name:      "signature_database_age_days",
+		Help:      "Days since the mcafee signature database was last updated.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		scansTotal,
+		infectedTotal,
+		scanDuration,
+		updatesTotal,
+		licenseDaysRemaining,
+		signatureDatabaseAgeDays,
+	)
+}
+
+// recordScanOutcomeMetrics updates scan counters/histograms for a completed
+// scan given just its verdict and duration, so callers that don't have a
+// full McAfee result (e.g. a batch entry) can still report metrics.
+func recordScanOutcomeMetrics(infected bool, duration time.Duration) {
+	scansTotal.Inc()
+	if infected {
+		infectedTotal.Inc()
+	}
+	scanDuration.Observe(duration.Seconds())
+}
+
+// recordScanMetrics updates scan counters/histograms for a completed scan.
+func recordScanMetrics(mcafee McAfee, duration time.Duration) {
+	recordScanOutcomeMetrics(mcafee.Results.Infected, duration)
+}
+
+// recordUpdateMetrics updates the update-result counter.
+func recordUpdateMetrics(err error) {
+	if err != nil {
+		updatesTotal.WithLabelValues("failure").Inc()
+		return
+	}
+	updatesTotal.WithLabelValues("success").Inc()
+}
+
+// refreshLicenseMetric recomputes the license-days-remaining gauge from the
+// mcafee license file's UpdateValidThru field.
+func refreshLicenseMetric() {
+	_, expiresAt, err := licenseExpiration()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Warn("failed to refresh license metric: ", err)
+		return
+	}
+	licenseDaysRemaining.Set(time.Until(expiresAt).Hours() / 24)
+}
+
+// refreshSignatureAgeMetric recomputes the signature-database-age gauge from
+// the mtime of /opt/malice/UPDATED.
+func refreshSignatureAgeMetric() {
+	info, err := os.Stat("/opt/malice/UPDATED")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Warn("failed to refresh signature database age metric: ", err)
+		return
+	}
+	signatureDatabaseAgeDays.Set(time.Since(info.ModTime()).Hours() / 24)
+}
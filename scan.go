@@ -23,7 +23,10 @@ import (
 	"github.com/malice-plugins/pkgs/utils"
 	"github.com/parnurzeal/gorequest"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli"
+
+	"github.com/malice-plugins/mcafee/history"
 )
 
 const (
@@ -41,8 +44,22 @@ var (
 
 	// es is the elasticsearch database object
 	es elasticsearch.Database
+
+	// scanRetry controls the backoff used when retrying a failed scan invocation
+	scanRetry = retryConfig{
+		Attempts:     2,
+		InitialDelay: 1 * time.Second,
+		MaxDelay:     10 * time.Second,
+	}
 )
 
+// retryConfig configures a bounded exponential-backoff retry loop.
+type retryConfig struct {
+	Attempts     int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
 type pluginResults struct {
 	ID   string      `json:"id" gorethink:"id,omitempty"`
 	Data ResultsData `json:"mcafee" gorethink:"mcafee"`
@@ -63,89 +80,185 @@ type ResultsData struct {
 	MarkDown string `json:"markdown,omitempty" structs:"markdown,omitempty"`
 }
 
-func assert(err error) {
-	if err != nil {
-		if err.Error() != "exit status 1" {
-			log.WithFields(log.Fields{
-				"plugin":   name,
-				"category": category,
-				"path":     path,
-			}).Fatal(err)
-		}
-	}
-}
-
-// AvScan performs antivirus scan
-func AvScan(timeout int) McAfee {
+// AvScan performs antivirus scan on targetPath, retrying the scan invocation
+// with a bounded exponential backoff (per scanRetry) before giving up.
+// targetPath is taken explicitly (mirroring batchScanPath) rather than via
+// the package-global path, since webService() serves scans concurrently and
+// a shared global would let one request's scan run against another's file.
+func AvScan(targetPath string, timeout int) (McAfee, error) {
 
 	// Give mcafeed 10 seconds to finish
 	mcafeedCtx, mcafeedCancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
 	defer mcafeedCancel()
 	// McAfee needs to have the daemon started first
-	_, err := utils.RunCommand(mcafeedCtx, "/etc/init.d/mcafee", "start")
-	assert(err)
-
-	var results ResultsData
+	if _, err := utils.RunCommand(mcafeedCtx, "/etc/init.d/mcafee", "start"); err != nil {
+		return McAfee{}, errors.Wrap(err, "failed to start mcafeed")
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
 	defer cancel()
 
-	output, err := utils.RunCommand(ctx, "scan", "-abfu", path)
-	assert(err)
-	results, err = ParseMcAfeeOutput(output)
+	var results ResultsData
+	delay := scanRetry.InitialDelay
 
-	if err != nil {
-		// If fails try a second time
-		output, err := utils.RunCommand(ctx, "scan", "-abfu", path)
-		assert(err)
-		results, err = ParseMcAfeeOutput(output)
-		assert(err)
+	for attempt := 1; attempt <= scanRetry.Attempts; attempt++ {
+		output, err := utils.RunCommand(ctx, "scan", "-abfu", targetPath)
+		if err == nil {
+			results, err = ParseMcAfeeOutput(targetPath, output)
+		}
+		if err == nil {
+			return McAfee{Results: results}, nil
+		}
+
+		if attempt == scanRetry.Attempts {
+			return McAfee{}, errors.Wrapf(err, "scan failed after %d attempts", scanRetry.Attempts)
+		}
+
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+			"path":     targetPath,
+			"attempt":  attempt,
+			"delay":    delay,
+		}).Warn("scan failed, retrying: ", err)
+
+		time.Sleep(delay)
+		delay *= 2
+		if delay > scanRetry.MaxDelay {
+			delay = scanRetry.MaxDelay
+		}
+	}
+
+	return McAfee{}, errors.New("scan failed: no attempts were made")
+}
+
+// FileResult is the verdict for a single file within a scan target, which
+// may be a single file, a directory, or an archive McAfee expanded in place.
+type FileResult struct {
+	Path     string `json:"path"`
+	Infected bool   `json:"infected"`
+	Result   string `json:"result,omitempty"`
+}
+
+// parseMcAfeeLine parses a single tab-separated line of `scan -abfu` output
+// into a FileResult. Clean files look like "<path>\t...\t[OK]"; infected
+// files look like "<path>\t<threat name>". Banner and blank lines have no
+// path/verdict delimiter and are not per-file results, so they're reported
+// as not-ok rather than being mis-flagged as infected. Summary totals lines
+// are tab-delimited and are not filtered here; ParseMcAfeeOutputMulti stops
+// before them.
+func parseMcAfeeLine(line string) (FileResult, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return FileResult{}, false
 	}
 
-	return McAfee{
-		Results: results,
+	fields := strings.SplitN(line, "\t", 2)
+	if len(fields) < 2 {
+		return FileResult{}, false
 	}
+
+	result := FileResult{Path: strings.TrimSpace(fields[0])}
+
+	if !strings.Contains(line, "[OK]") {
+		result.Infected = true
+		result.Result = strings.TrimSpace(fields[1])
+	}
+
+	return result, true
+}
+
+// ParseMcAfeeOutputMulti parses every line McAfee emits for a scan target
+// (a single file, a directory, or an expanded archive) into a per-entry
+// FileResult, so callers can report a verdict for each file found. Parsing
+// stops at the "Summary report:" marker, since the totals lines below it
+// ("File(s) scanned\t: 1") are themselves tab-delimited and would otherwise
+// be mistaken for infected per-file results.
+func ParseMcAfeeOutputMulti(mcafeeout string) ([]FileResult, error) {
+	var results []FileResult
+
+	for _, line := range strings.Split(mcafeeout, "\n") {
+		if strings.TrimSpace(line) == "Summary report:" {
+			break
+		}
+		if result, ok := parseMcAfeeLine(line); ok {
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+// aggregateFileResults reduces a set of per-file verdicts into a single
+// infected flag and a combined, comma-separated threat name so that no
+// detection is silently dropped when a directory/archive has more than one.
+func aggregateFileResults(files []FileResult) (infected bool, result string) {
+	var threats []string
+	for _, file := range files {
+		if file.Infected {
+			infected = true
+			threats = append(threats, file.Result)
+		}
+	}
+	return infected, strings.Join(threats, ", ")
 }
 
 // ParseMcAfeeOutput convert mcafee output into ResultsData struct
-func ParseMcAfeeOutput(mcafeeout string) (ResultsData, error) {
+func ParseMcAfeeOutput(targetPath, mcafeeout string) (ResultsData, error) {
 
 	log.WithFields(log.Fields{
 		"plugin":   name,
 		"category": category,
-		"path":     path,
+		"path":     targetPath,
 	}).Debug("McAfee Output: ", mcafeeout)
 
+	version, err := getMcAfeeVersion()
+	if err != nil {
+		return ResultsData{}, errors.Wrap(err, "failed to get mcafee version")
+	}
+	dbVersion, err := getMcAfeeVPS()
+	if err != nil {
+		return ResultsData{}, errors.Wrap(err, "failed to get mcafee database version")
+	}
+	updated, err := getUpdatedDate()
+	if err != nil {
+		return ResultsData{}, errors.Wrap(err, "failed to get mcafee database updated date")
+	}
+
 	mcafee := ResultsData{
 		Infected: false,
-		Engine:   getMcAfeeVersion(),
-		Database: getMcAfeeVPS(),
-		Updated:  getUpdatedDate(),
+		Engine:   version,
+		Database: dbVersion,
+		Updated:  updated,
 	}
 
-	result := strings.Split(mcafeeout, "\t")
-
-	if !strings.Contains(mcafeeout, "[OK]") {
-		mcafee.Infected = true
-		mcafee.Result = strings.TrimSpace(result[1])
+	files, err := ParseMcAfeeOutputMulti(mcafeeout)
+	if err != nil {
+		return ResultsData{}, errors.Wrap(err, "failed to parse mcafee output")
 	}
 
+	mcafee.Infected, mcafee.Result = aggregateFileResults(files)
+
 	return mcafee, nil
 }
 
 // Get Anti-Virus scanner version
-func getMcAfeeVersion() string {
+func getMcAfeeVersion() (string, error) {
 	versionOut, err := utils.RunCommand(nil, "/bin/scan", "-v")
-	assert(err)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to run scan -v")
+	}
 	log.Debug("McAfee Version: ", versionOut)
-	return strings.TrimSpace(versionOut)
+	return strings.TrimSpace(versionOut), nil
 }
 
-func getMcAfeeVPS() string {
+func getMcAfeeVPS() (string, error) {
 	versionOut, err := utils.RunCommand(nil, "/bin/scan", "-V")
-	assert(err)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to run scan -V")
+	}
 	log.Debug("McAfee Database: ", versionOut)
-	return strings.TrimSpace(versionOut)
+	return strings.TrimSpace(versionOut), nil
 }
 
 func parseUpdatedDate(date string) string {
@@ -154,33 +267,48 @@ func parseUpdatedDate(date string) string {
 	return fmt.Sprintf("%d%02d%02d", t.Year(), t.Month(), t.Day())
 }
 
-func getUpdatedDate() string {
+func getUpdatedDate() (string, error) {
 	if _, err := os.Stat("/opt/malice/UPDATED"); os.IsNotExist(err) {
-		return BuildTime
+		return BuildTime, nil
 	}
 	updated, err := ioutil.ReadFile("/opt/malice/UPDATED")
-	assert(err)
-	return string(updated)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read /opt/malice/UPDATED")
+	}
+	return string(updated), nil
 }
 
 func updateAV(ctx context.Context) error {
 	fmt.Println("Updating McAfee...")
 	// McAfee needs to have the daemon started first
-	exec.Command("/etc/init.d/mcafee", "start").Output()
+	if err := exec.Command("/etc/init.d/mcafee", "start").Run(); err != nil {
+		return errors.Wrap(err, "failed to start mcafeed")
+	}
+
+	out, err := utils.RunCommand(ctx, "/var/lib/mcafee/Setup/mcafee.vpsupdate")
+	if err != nil {
+		return errors.Wrap(err, "failed to run mcafee.vpsupdate")
+	}
+	fmt.Println(out)
 
-	fmt.Println(utils.RunCommand(ctx, "/var/lib/mcafee/Setup/mcafee.vpsupdate"))
 	// Update UPDATED file
 	t := time.Now().Format("20060102")
-	err := ioutil.WriteFile("/opt/malice/UPDATED", []byte(t), 0644)
-	return err
+	if err := ioutil.WriteFile("/opt/malice/UPDATED", []byte(t), 0644); err != nil {
+		return errors.Wrap(err, "failed to write /opt/malice/UPDATED")
+	}
+	return nil
 }
 
-func didLicenseExpire() bool {
+// licenseExpiration parses the mcafee license file and returns whether it has
+// expired along with its expiration time.
+func licenseExpiration() (expired bool, expiresAt time.Time, err error) {
 	if _, err := os.Stat("/etc/mcafee/license.mcafeelic"); os.IsNotExist(err) {
-		log.Fatal("could not find mcafee license file")
+		return false, time.Time{}, errors.Wrap(err, "could not find mcafee license file")
 	}
 	license, err := ioutil.ReadFile("/etc/mcafee/license.mcafeelic")
-	assert(err)
+	if err != nil {
+		return false, time.Time{}, errors.Wrap(err, "failed to read mcafee license file")
+	}
 
 	lines := strings.Split(string(license), "\n")
 	// Extract Virus string and extract colon separated lines into an slice
@@ -191,7 +319,7 @@ func didLicenseExpire() bool {
 				// 1501774374
 				i, err := strconv.ParseInt(expireDate, 10, 64)
 				if err != nil {
-					log.Fatal(err)
+					return false, time.Time{}, errors.Wrap(err, "failed to parse license expiration date")
 				}
 				expires := time.Unix(i, 0)
 				log.WithFields(log.Fields{
@@ -199,13 +327,17 @@ func didLicenseExpire() bool {
 					"category": category,
 					"expired":  expires.Before(time.Now()),
 				}).Debug("McAfee License Expires: ", expires)
-				return expires.Before(time.Now())
+				return expires.Before(time.Now()), expires, nil
 			}
 		}
 	}
 
-	log.Error("could not find expiration date in license file")
-	return false
+	return false, time.Time{}, errors.New("could not find expiration date in license file")
+}
+
+func didLicenseExpire() (bool, error) {
+	expired, _, err := licenseExpiration()
+	return expired, err
 }
 
 func generateMarkDownTable(a McAfee) string {
@@ -228,6 +360,22 @@ func printStatus(resp gorequest.Response, body string, errs []error) {
 func webService() {
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc("/scan", webAvScan).Methods("POST")
+	router.HandleFunc("/scan/aggregate", webAggregateScan).Methods("POST")
+	router.HandleFunc("/scan/diff", webDiffScan).Methods("POST")
+	router.HandleFunc("/scan/batch", webBatchScan).Methods("POST")
+	router.HandleFunc("/scan/history", webListScanHistory).Methods("GET")
+	router.HandleFunc("/scan/history/{sha256}", webScanHistory).Methods("GET")
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	refreshLicenseMetric()
+	refreshSignatureAgeMetric()
+	go func() {
+		for range time.Tick(1 * time.Hour) {
+			refreshLicenseMetric()
+			refreshSignatureAgeMetric()
+		}
+	}()
+
 	log.WithFields(log.Fields{
 		"plugin":   name,
 		"category": category,
@@ -235,48 +383,89 @@ func webService() {
 	log.Fatal(http.ListenAndServe(":3993", router))
 }
 
+// errorResponse is the JSON body returned by web handlers on failure.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeError translates err into a JSON error response with the given status code.
+func writeError(w http.ResponseWriter, status int, err error) {
+	log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"status":   status,
+	}).Error(err)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: err.Error()})
+}
+
 func webAvScan(w http.ResponseWriter, r *http.Request) {
 
+	started := time.Now()
+	reqLog := log.WithFields(log.Fields{
+		"plugin":   name,
+		"category": category,
+		"remote":   r.RemoteAddr,
+	})
+
 	r.ParseMultipartForm(32 << 20)
 	file, header, err := r.FormFile("malware")
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintln(w, "Please supply a valid file to scan.")
-		log.WithFields(log.Fields{
-			"plugin":   name,
-			"category": category,
-		}).Error(err)
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "please supply a valid file to scan"))
+		return
 	}
 	defer file.Close()
 
-	log.WithFields(log.Fields{
-		"plugin":   name,
-		"category": category,
-	}).Debug("Uploaded fileName: ", header.Filename)
+	reqLog = reqLog.WithField("filename", header.Filename)
+	reqLog.WithField("size", header.Size).Debug("received upload")
 
 	tmpfile, err := ioutil.TempFile("/malware", "web_")
-	assert(err)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to create temp file"))
+		return
+	}
 	defer os.Remove(tmpfile.Name()) // clean up
 
 	data, err := ioutil.ReadAll(file)
-	assert(err)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to read uploaded file"))
+		return
+	}
 
 	if _, err = tmpfile.Write(data); err != nil {
-		assert(err)
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to write temp file"))
+		return
 	}
 	if err = tmpfile.Close(); err != nil {
-		assert(err)
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to close temp file"))
+		return
 	}
 
 	// Do AV scan
-	path = tmpfile.Name()
-	mcafee := AvScan(60)
+	scanPath := tmpfile.Name()
+	sha256 := utils.GetSHA256(scanPath)
+	reqLog = reqLog.WithField("sha256", sha256)
+
+	mcafee, err := AvScan(scanPath, 60)
+	duration := time.Since(started)
+	if err != nil {
+		reqLog.WithField("duration", duration).Error("scan failed: ", err)
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to scan file"))
+		return
+	}
+	recordScanMetrics(mcafee, duration)
+
+	reqLog.WithFields(log.Fields{
+		"duration": duration,
+		"verdict":  mcafee.Results.Infected,
+	}).Info("completed scan")
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 
 	if err := json.NewEncoder(w).Encode(mcafee); err != nil {
-		assert(err)
+		reqLog.Error(errors.Wrap(err, "failed to encode scan response"))
 	}
 }
 
@@ -323,6 +512,42 @@ func main() {
 			Usage:  "malice plugin timeout (in seconds)",
 			EnvVar: "MALICE_TIMEOUT",
 		},
+		cli.BoolFlag{
+			Name:  "diff, d",
+			Usage: "diff this scan against the last scan of the same file",
+		},
+		cli.StringFlag{
+			Name:   "history-dir",
+			Value:  "",
+			Usage:  "directory to persist/load scan history for --diff (defaults to history.DefaultDir)",
+			EnvVar: "MALICE_HISTORY_DIR",
+		},
+		cli.IntFlag{
+			Name:   "scan-attempts",
+			Value:  2,
+			Usage:  "number of times to attempt a scan before giving up",
+			EnvVar: "MALICE_SCAN_ATTEMPTS",
+		},
+		cli.DurationFlag{
+			Name:   "scan-initial-delay",
+			Value:  1 * time.Second,
+			Usage:  "initial delay before retrying a failed scan",
+			EnvVar: "MALICE_SCAN_INITIAL_DELAY",
+		},
+		cli.DurationFlag{
+			Name:   "scan-max-delay",
+			Value:  10 * time.Second,
+			Usage:  "maximum backoff delay between scan retries",
+			EnvVar: "MALICE_SCAN_MAX_DELAY",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		scanRetry = retryConfig{
+			Attempts:     c.GlobalInt("scan-attempts"),
+			InitialDelay: c.GlobalDuration("scan-initial-delay"),
+			MaxDelay:     c.GlobalDuration("scan-max-delay"),
+		}
+		return nil
 	}
 	app.Commands = []cli.Command{
 		{
@@ -330,7 +555,9 @@ func main() {
 			Aliases: []string{"u"},
 			Usage:   "Update virus definitions",
 			Action: func(c *cli.Context) error {
-				return updateAV(nil)
+				err := updateAV(nil)
+				recordUpdateMetrics(err)
+				return err
 			},
 		},
 		{
@@ -341,6 +568,35 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "aggregate",
+			Usage: "Scan a file with McAfee and merge in results from sibling malice-plugins scanners",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:   "endpoint, e",
+					Usage:  "sibling scanner /scan endpoint (repeatable)",
+					EnvVar: "MALICE_AGGREGATE_ENDPOINTS",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if !c.Args().Present() {
+					return fmt.Errorf("Please supply a file to scan with malice/mcafee")
+				}
+				var err error
+				path, err = filepath.Abs(c.Args().First())
+				if err != nil {
+					return errors.Wrap(err, "failed to resolve file path")
+				}
+
+				report := aggregateScan(path, c.GlobalInt("timeout"), c.StringSlice("endpoint"))
+				reportJSON, err := json.Marshal(report)
+				if err != nil {
+					return errors.Wrap(err, "failed to marshal aggregate report")
+				}
+				fmt.Println(string(reportJSON))
+				return nil
+			},
+		},
 	}
 	app.Action = func(c *cli.Context) error {
 
@@ -352,18 +608,54 @@ func main() {
 
 		if c.Args().Present() {
 			path, err = filepath.Abs(c.Args().First())
-			assert(err)
+			if err != nil {
+				return errors.Wrap(err, "failed to resolve file path")
+			}
 
 			if _, err = os.Stat(path); os.IsNotExist(err) {
-				assert(err)
+				return errors.Wrapf(err, "file %s does not exist", path)
 			}
 
-			if didLicenseExpire() {
+			expired, err := didLicenseExpire()
+			if err != nil {
+				return errors.Wrap(err, "failed to check mcafee license expiration")
+			}
+			if expired {
 				log.Errorln("mcafee license has expired")
 				log.Errorln("please get a new one here: https://www.mcafee.com/linux-server-antivirus")
 			}
 
-			mcafee := AvScan(c.Int("timeout"))
+			if info, statErr := os.Stat(path); statErr == nil && info.IsDir() {
+				result, err := batchScanPath(path, c.Int("timeout"))
+				if err != nil {
+					return errors.Wrap(err, "failed to scan directory")
+				}
+				resultJSON, err := json.Marshal(result)
+				if err != nil {
+					return errors.Wrap(err, "failed to marshal batch scan result")
+				}
+				fmt.Println(string(resultJSON))
+				return nil
+			}
+
+			var mcafee McAfee
+			if c.Bool("diff") {
+				var diff ScanDiff
+				diff, mcafee, err = diffScan(history.NewStore(c.String("history-dir")), path, c.Int("timeout"))
+				if err != nil {
+					return errors.Wrap(err, "failed to diff scan against history")
+				}
+				diffJSON, err := json.Marshal(diff)
+				if err != nil {
+					return errors.Wrap(err, "failed to marshal scan diff")
+				}
+				fmt.Println(string(diffJSON))
+			} else {
+				mcafee, err = AvScan(path, c.Int("timeout"))
+				if err != nil {
+					return errors.Wrap(err, "failed to scan file")
+				}
+			}
 			mcafee.Results.MarkDown = generateMarkDownTable(mcafee)
 			// upsert into Database
 			if len(c.String("elasticsearch")) > 0 {
@@ -387,7 +679,9 @@ func main() {
 			} else {
 				mcafee.Results.MarkDown = ""
 				mcafeeJSON, err := json.Marshal(mcafee)
-				assert(err)
+				if err != nil {
+					return errors.Wrap(err, "failed to marshal scan result")
+				}
 				if c.Bool("callback") {
 					request := gorequest.New()
 					if c.Bool("proxy") {
@@ -403,14 +697,15 @@ func main() {
 				fmt.Println(string(mcafeeJSON))
 			}
 		} else {
-			log.WithFields(log.Fields{
-				"plugin":   name,
-				"category": category,
-			}).Fatal(fmt.Errorf("Please supply a file to scan with malice/mcafee"))
+			return fmt.Errorf("please supply a file to scan with malice/mcafee")
 		}
 		return nil
 	}
 
-	err := app.Run(os.Args)
-	assert(err)
+	if err := app.Run(os.Args); err != nil {
+		log.WithFields(log.Fields{
+			"plugin":   name,
+			"category": category,
+		}).Fatal(err)
+	}
 }
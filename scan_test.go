@@ -0,0 +1,178 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Captured-style `scan -abfu` output covering the shapes this parser must
+// handle: a banner with no path/verdict delimiter, a tab-delimited summary
+// after the "Summary report:" marker, clean entries, a single infected file,
+// and a mixed archive with both.
+
+const cleanOutput = `McAfeeVSCL Copyright (C) 1989-2018 McAfee, Inc.
+(408) 988-3832 LIN_UVSCAN 6.1.0
+
+Virus Database (DAT) version 9999.0
+
+/malware/clean.txt			[OK]
+
+Summary report:
+File(s) scanned	: 1
+Possibly Infected	: 0
+`
+
+const infectedOutput = `McAfeeVSCL Copyright (C) 1989-2018 McAfee, Inc.
+(408) 988-3832 LIN_UVSCAN 6.1.0
+
+Virus Database (DAT) version 9999.0
+
+/malware/eicar.com	EICAR test file
+
+Summary report:
+File(s) scanned	: 1
+Possibly Infected	: 1
+`
+
+const mixedArchiveOutput = `McAfeeVSCL Copyright (C) 1989-2018 McAfee, Inc.
+(408) 988-3832 LIN_UVSCAN 6.1.0
+
+Virus Database (DAT) version 9999.0
+
+/malware/archive.zip/clean.txt			[OK]
+/malware/archive.zip/eicar.com	EICAR test file
+/malware/archive.zip/trojan.exe	Generic Trojan.abc
+
+Summary report:
+File(s) scanned	: 3
+Possibly Infected	: 2
+`
+
+func TestParseMcAfeeLine(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string
+		wantResult FileResult
+		wantOK     bool
+	}{
+		{
+			name:   "blank line is not a result",
+			line:   "   ",
+			wantOK: false,
+		},
+		{
+			name:   "banner line with no delimiter is not a result",
+			line:   "McAfeeVSCL Copyright (C) 1989-2018 McAfee, Inc.",
+			wantOK: false,
+		},
+		{
+			name:       "clean file",
+			line:       "/malware/clean.txt\t\t\t[OK]",
+			wantResult: FileResult{Path: "/malware/clean.txt", Infected: false},
+			wantOK:     true,
+		},
+		{
+			name:       "infected file",
+			line:       "/malware/eicar.com\tEICAR test file",
+			wantResult: FileResult{Path: "/malware/eicar.com", Infected: true, Result: "EICAR test file"},
+			wantOK:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseMcAfeeLine(tt.line)
+			if ok != tt.wantOK {
+				t.Fatalf("parseMcAfeeLine(%q) ok = %v, want %v", tt.line, ok, tt.wantOK)
+			}
+			if ok && !reflect.DeepEqual(got, tt.wantResult) {
+				t.Fatalf("parseMcAfeeLine(%q) = %+v, want %+v", tt.line, got, tt.wantResult)
+			}
+		})
+	}
+}
+
+func TestParseMcAfeeOutputMulti(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []FileResult
+	}{
+		{
+			name:   "clean",
+			output: cleanOutput,
+			want: []FileResult{
+				{Path: "/malware/clean.txt", Infected: false},
+			},
+		},
+		{
+			name:   "infected",
+			output: infectedOutput,
+			want: []FileResult{
+				{Path: "/malware/eicar.com", Infected: true, Result: "EICAR test file"},
+			},
+		},
+		{
+			name:   "mixed archive",
+			output: mixedArchiveOutput,
+			want: []FileResult{
+				{Path: "/malware/archive.zip/clean.txt", Infected: false},
+				{Path: "/malware/archive.zip/eicar.com", Infected: true, Result: "EICAR test file"},
+				{Path: "/malware/archive.zip/trojan.exe", Infected: true, Result: "Generic Trojan.abc"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMcAfeeOutputMulti(tt.output)
+			if err != nil {
+				t.Fatalf("ParseMcAfeeOutputMulti returned error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseMcAfeeOutputMulti() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregateFileResults(t *testing.T) {
+	tests := []struct {
+		name         string
+		files        []FileResult
+		wantInfected bool
+		wantResult   string
+	}{
+		{
+			name:         "all clean",
+			files:        []FileResult{{Path: "a", Infected: false}, {Path: "b", Infected: false}},
+			wantInfected: false,
+			wantResult:   "",
+		},
+		{
+			name:         "single infected",
+			files:        []FileResult{{Path: "a", Infected: false}, {Path: "b", Infected: true, Result: "EICAR test file"}},
+			wantInfected: true,
+			wantResult:   "EICAR test file",
+		},
+		{
+			name: "multiple infected entries are all surfaced, not just the first",
+			files: []FileResult{
+				{Path: "a", Infected: true, Result: "EICAR test file"},
+				{Path: "b", Infected: false},
+				{Path: "c", Infected: true, Result: "Generic Trojan.abc"},
+			},
+			wantInfected: true,
+			wantResult:   "EICAR test file, Generic Trojan.abc",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			infected, result := aggregateFileResults(tt.files)
+			if infected != tt.wantInfected || result != tt.wantResult {
+				t.Fatalf("aggregateFileResults() = (%v, %q), want (%v, %q)", infected, result, tt.wantInfected, tt.wantResult)
+			}
+		})
+	}
+}